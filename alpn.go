@@ -0,0 +1,150 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdlib.h>
+// #include <openssl/ssl.h>
+//
+// extern int alpn_select_cb(SSL *ssl, const unsigned char **out,
+//     unsigned char *outlen, const unsigned char *in, unsigned int inlen,
+//     void *arg);
+import "C"
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// alpnProtos holds the wire-encoded protocol list a Ctx advertises. It's
+// looked up from the select callback by the raw SSL_CTX pointer, since we
+// have no Go-level hook into a live *SSL at that point.
+type alpnProtos struct {
+	wire []byte
+}
+
+var (
+	alpn_protos_mu sync.Mutex
+	alpn_protos    = map[unsafe.Pointer]*alpnProtos{}
+)
+
+// encodeALPNProtos turns a list of protocol names into the length-prefixed
+// wire format OpenSSL expects for both SSL_CTX_set_alpn_protos and the
+// alpn_select_cb callback: 0x02 "h2" 0x08 "http/1.1" ...
+func encodeALPNProtos(protos []string) ([]byte, error) {
+	var wire []byte
+	for _, p := range protos {
+		if len(p) == 0 || len(p) > 255 {
+			return nil, errors.New("openssl: invalid ALPN protocol name length")
+		}
+		wire = append(wire, byte(len(p)))
+		wire = append(wire, p...)
+	}
+	return wire, nil
+}
+
+// decodeALPNProtos splits the wire format back into protocol names.
+func decodeALPNProtos(wire []byte) []string {
+	var protos []string
+	for len(wire) > 0 {
+		n := int(wire[0])
+		wire = wire[1:]
+		if n > len(wire) {
+			break
+		}
+		protos = append(protos, string(wire[:n]))
+		wire = wire[n:]
+	}
+	return protos
+}
+
+// SetNextProtos sets the list of protocols this Ctx supports, in preference
+// order. On the client side, they are advertised via the ALPN extension. On
+// the server side, they are used to select the mutually supported protocol
+// out of the client's advertised list, preferring our own order. See
+// https://tools.ietf.org/html/rfc7301
+func (c *Ctx) SetNextProtos(protos []string) error {
+	wire, err := encodeALPNProtos(protos)
+	if err != nil {
+		return err
+	}
+
+	alpn_protos_mu.Lock()
+	alpn_protos[unsafe.Pointer(c.ctx)] = &alpnProtos{wire: wire}
+	alpn_protos_mu.Unlock()
+
+	if len(wire) > 0 {
+		if C.SSL_CTX_set_alpn_protos(c.ctx, (*C.uchar)(&wire[0]),
+			C.uint(len(wire))) != 0 {
+			return errorFromErrorQueue()
+		}
+	}
+
+	C.SSL_CTX_set_alpn_select_cb(c.ctx,
+		(*[0]byte)(C.alpn_select_cb), nil)
+	return nil
+}
+
+//export alpn_select_cb_thunk
+func alpn_select_cb_thunk(ssl *C.SSL, out **C.uchar, outlen *C.uchar,
+	in *C.uchar, inlen C.uint) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: alpn select callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	ctx := C.SSL_get_SSL_CTX(ssl)
+	alpn_protos_mu.Lock()
+	ap, found := alpn_protos[unsafe.Pointer(ctx)]
+	alpn_protos_mu.Unlock()
+	if !found {
+		return C.SSL_TLSEXT_ERR_NOACK
+	}
+
+	clientProtos := decodeALPNProtos(C.GoBytes(unsafe.Pointer(in), C.int(inlen)))
+
+	offset := 0
+	for _, want := range decodeALPNProtos(ap.wire) {
+		for _, got := range clientProtos {
+			if want == got {
+				// out must point into memory that outlives the callback, so
+				// point back into ap.wire, which alpn_protos keeps alive
+				*out = (*C.uchar)(unsafe.Pointer(&ap.wire[offset+1]))
+				*outlen = C.uchar(len(want))
+				return C.SSL_TLSEXT_ERR_OK
+			}
+		}
+		offset += len(want) + 1
+	}
+	return C.SSL_TLSEXT_ERR_NOACK
+}
+
+// NegotiatedProtocol returns the protocol that was negotiated via ALPN, if
+// any, and whether negotiation happened at all. Only valid after a
+// handshake. See Ctx.SetNextProtos.
+func (c *Conn) NegotiatedProtocol() (proto string, ok bool) {
+	var data *C.uchar
+	var length C.uint
+	C.SSL_get0_alpn_selected(c.ssl, &data, &length)
+	if length == 0 {
+		return "", false
+	}
+	return string(C.GoBytes(unsafe.Pointer(data), C.int(length))), true
+}
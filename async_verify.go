@@ -0,0 +1,294 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdlib.h>
+// #include <openssl/ssl.h>
+// #include <openssl/x509.h>
+// #include <openssl/x509_vfy.h>
+//
+// int sk_X509_num_av(STACK_OF(X509) *sk) { return sk_X509_num(sk); }
+// X509 *sk_X509_value_av(STACK_OF(X509) *sk, int i) {
+//    return sk_X509_value(sk, i);
+// }
+// void sk_X509_push_av(STACK_OF(X509) *sk, X509 *x) { sk_X509_push(sk, x); }
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// AsyncVerifyResult is the verdict an async verifier helper returns for one
+// certificate chain: either the built-in verification result is accepted,
+// or replaced with a different OpenSSL error code, optionally along with
+// additional intermediate certificates the helper located (e.g. via AIA
+// chasing) that should be added to the chain being verified.
+type AsyncVerifyResult struct {
+	OK            bool
+	ErrorCode     int
+	Intermediates []*Certificate
+}
+
+// asyncVerifyRequest is what we send to a helper: the server name we're
+// connecting to or terminating, the chain being verified (leaf first, PEM
+// encoded, one cert per line-wrapped block collapsed to a single base64
+// blob), and the error code OpenSSL's built-in verification already came up
+// with.
+type asyncVerifyRequest struct {
+	host      string
+	chainPEM  []byte
+	errorCode int
+}
+
+type asyncVerifyJob struct {
+	req    asyncVerifyRequest
+	result chan asyncVerifyResult
+}
+
+type asyncVerifyResult struct {
+	res AsyncVerifyResult
+	err error
+}
+
+// asyncVerifier is a pool of long-running helper subprocesses speaking a
+// simple line-framed request/response protocol, in the spirit of Squid's
+// ssl_crtd/cert-validation helper. Each request line is
+// "host\terrcode\tbase64(chain PEM)\n"; each response line is
+// "ok|fail\terrcode\tbase64(intermediate1),base64(intermediate2),...\n".
+type asyncVerifier struct {
+	cmd  string
+	jobs chan asyncVerifyJob
+}
+
+// SetAsyncVerifier spawns workers long-running copies of cmd and routes
+// subsequent peer certificate verifications on this Ctx through them. Only
+// connections whose SSL has a VerifyCallback set via SSL.SetVerify consult
+// the helper; it runs in addition to that callback, which then sees the
+// helper's verdict. Connections without such a callback are not sent to the
+// helper. This lets verification do OCSP fetches, CT log checks, or corporate PKI
+// lookups off this process's own goroutines; it still blocks the calling
+// connection's own handshake goroutine for the helper round-trip (see
+// asyncVerifier.verify), so size workers for peak concurrent handshakes.
+func (c *Ctx) SetAsyncVerifier(cmd string, workers int) error {
+	if workers <= 0 {
+		return errors.New("openssl: SetAsyncVerifier needs at least one worker")
+	}
+	av := &asyncVerifier{
+		cmd:  cmd,
+		jobs: make(chan asyncVerifyJob),
+	}
+	for i := 0; i < workers; i++ {
+		w, err := startAsyncVerifyWorker(cmd)
+		if err != nil {
+			return fmt.Errorf("openssl: starting async verifier worker: %s", err)
+		}
+		go w.run(av.jobs)
+	}
+
+	async_verifiers_mu.Lock()
+	async_verifiers[unsafe.Pointer(c.ctx)] = av
+	async_verifiers_mu.Unlock()
+	return nil
+}
+
+var (
+	async_verifiers_mu sync.Mutex
+	async_verifiers    = map[unsafe.Pointer]*asyncVerifier{}
+)
+
+func asyncVerifierFor(ctx *C.SSL_CTX) *asyncVerifier {
+	async_verifiers_mu.Lock()
+	defer async_verifiers_mu.Unlock()
+	return async_verifiers[unsafe.Pointer(ctx)]
+}
+
+type asyncVerifyWorker struct {
+	proc   *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startAsyncVerifyWorker(cmd string) (*asyncVerifyWorker, error) {
+	proc := exec.Command(cmd)
+	stdin, err := proc.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := proc.Start(); err != nil {
+		return nil, err
+	}
+	return &asyncVerifyWorker{
+		proc:   proc,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// run services jobs off the shared channel for as long as the helper
+// process is alive, one at a time, matching the helper's own line-framed
+// request/response protocol.
+func (w *asyncVerifyWorker) run(jobs chan asyncVerifyJob) {
+	for job := range jobs {
+		res, err := w.roundTrip(job.req)
+		job.result <- asyncVerifyResult{res: res, err: err}
+	}
+}
+
+func (w *asyncVerifyWorker) roundTrip(req asyncVerifyRequest) (AsyncVerifyResult, error) {
+	line := fmt.Sprintf("%s\t%d\t%s\n", req.host, req.errorCode,
+		base64.StdEncoding.EncodeToString(req.chainPEM))
+	if _, err := io.WriteString(w.stdin, line); err != nil {
+		return AsyncVerifyResult{}, err
+	}
+
+	resp, err := w.stdout.ReadString('\n')
+	if err != nil {
+		return AsyncVerifyResult{}, err
+	}
+	fields := strings.SplitN(strings.TrimRight(resp, "\n"), "\t", 3)
+	if len(fields) < 2 {
+		return AsyncVerifyResult{}, errors.New("openssl: malformed async verifier response")
+	}
+
+	res := AsyncVerifyResult{OK: fields[0] == "ok"}
+	res.ErrorCode, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return AsyncVerifyResult{}, fmt.Errorf("openssl: malformed async verifier error code: %s", err)
+	}
+	if len(fields) == 3 && len(fields[2]) > 0 {
+		for _, b64 := range strings.Split(fields[2], ",") {
+			der, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return AsyncVerifyResult{}, fmt.Errorf("openssl: malformed async verifier intermediate: %s", err)
+			}
+			cert, err := certificateFromDER(der)
+			if err != nil {
+				return AsyncVerifyResult{}, err
+			}
+			res.Intermediates = append(res.Intermediates, cert)
+		}
+	}
+	return res, nil
+}
+
+func certificateFromDER(der []byte) (*Certificate, error) {
+	p := (*C.uchar)(&der[0])
+	x := C.d2i_X509(nil, &p, C.long(len(der)))
+	if x == nil {
+		return nil, errorFromErrorQueue()
+	}
+	cert := &Certificate{x: x}
+	runtime.SetFinalizer(cert, func(cert *Certificate) {
+		C.X509_free(cert.x)
+	})
+	return cert, nil
+}
+
+// chainToPEM PEM-encodes the leaf-first certificate chain OpenSSL built up
+// so far for a verification pass, for shipping off to an async verifier.
+func chainToPEM(store_ctx *C.X509_STORE_CTX) ([]byte, error) {
+	sk := C.X509_STORE_CTX_get0_chain(store_ctx)
+	if sk == nil {
+		return nil, errors.New("openssl: no chain to verify")
+	}
+	var buf bytes.Buffer
+	count := int(C.sk_X509_num_av(sk))
+	for i := 0; i < count; i++ {
+		x := C.sk_X509_value_av(sk, C.int(i))
+		size := C.i2d_X509(x, nil)
+		if size <= 0 {
+			return nil, errorFromErrorQueue()
+		}
+		der := make([]byte, size)
+		p := (*C.uchar)(&der[0])
+		if C.i2d_X509(x, &p) <= 0 {
+			return nil, errorFromErrorQueue()
+		}
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// verify hands the in-progress verification of store off to the Ctx's async
+// verifier and blocks this connection's handshake goroutine -- but no
+// other -- until the helper responds. host is the server name this
+// connection negotiated (e.g. via SNI). The helper sees OpenSSL's built-in
+// verification result via store's current error code.
+//
+// This blocks inside the OpenSSL library call (X509_verify_cert, itself
+// inside SSL_do_handshake) for the full helper round-trip: OpenSSL's public
+// verify callback has no supported way to suspend mid-verification and
+// resume later the way SSL_ERROR_WANT_READ/WANT_WRITE let a read or write
+// yield back to the tryAgain loop in conn.go. Making this non-blocking
+// would need SSL_CTX_set_cert_verify_callback plus a libssl new enough to
+// carry SSL_set_retry_verify/SSL_ERROR_WANT_RETRY_VERIFY, which is a
+// bigger rework than this callback shape supports today. Only this
+// connection's handshake goroutine stalls, so other connections on the
+// same Ctx make progress concurrently; callers with latency-sensitive
+// handshakes should size the worker pool for peak concurrent handshakes.
+func (av *asyncVerifier) verify(store *CertificateStoreCtx, host string) bool {
+	chainPEM, err := chainToPEM(store.ctx)
+	if err != nil {
+		logger.Errf("openssl: async verifier: %s", err)
+		return false
+	}
+
+	req := asyncVerifyRequest{
+		host:      host,
+		chainPEM:  chainPEM,
+		errorCode: int(C.X509_STORE_CTX_get_error(store.ctx)),
+	}
+	result := make(chan asyncVerifyResult, 1)
+	av.jobs <- asyncVerifyJob{req: req, result: result}
+	resp := <-result
+	if resp.err != nil {
+		logger.Errf("openssl: async verifier: %s", resp.err)
+		return false
+	}
+
+	untrusted := C.X509_STORE_CTX_get0_untrusted(store.ctx)
+	for _, extra := range resp.res.Intermediates {
+		// sk_X509_push does not take a reference; extra is still owned by
+		// the Certificate's own X509_free finalizer, so bump the refcount
+		// before handing the X509 to a stack we don't control the lifetime
+		// of, or the finalizer running while store_ctx still holds it would
+		// free memory the chain builder is still walking.
+		C.X509_up_ref(extra.x)
+		C.sk_X509_push_av(untrusted, extra.x)
+	}
+
+	C.X509_STORE_CTX_set_error(store.ctx, C.int(resp.res.ErrorCode))
+	return resp.res.OK
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <openssl/bio.h>
+// #include <openssl/ssl.h>
+import "C"
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// BIO wraps an OpenSSL BIO, OpenSSL's I/O abstraction layer. It's exposed
+// so a custom BIOFactory can hand back BIOs other than the Go-implemented
+// memory BIOs newConn wires up by default -- e.g. for DTLS-over-UDP,
+// in-memory pipes for testing, or kTLS via BIO_new_dgram.
+type BIO struct {
+	bio *C.BIO
+}
+
+// NewFDBIO wraps an existing, already-connected file descriptor in a
+// socket BIO, the same kind of BIO ClientFD/ServerFD build by default, for use
+// in a BIOFactory; most callers with a plain file descriptor
+// want ClientFD/ServerFD instead and won't need this directly.
+//
+// A *BIO returned here is only freed by its finalizer while it's unowned.
+// Once it's handed to SSL_set_bio (e.g. via a BIOFactory), SSL_free takes
+// over ownership and the finalizer is cleared so the BIO isn't freed twice.
+func NewFDBIO(fd uintptr) (*BIO, error) {
+	cbio := C.BIO_new_socket(C.int(fd), C.int(0))
+	if cbio == nil {
+		return nil, errorFromErrorQueue()
+	}
+	b := &BIO{bio: cbio}
+	runtime.SetFinalizer(b, func(b *BIO) {
+		C.BIO_free(b.bio)
+	})
+	return b, nil
+}
+
+// BIOFactory builds a fresh pair of BIOs -- read side, then write side --
+// to be installed by ClientFD/ServerFD on a new connection via SSL_set_bio,
+// in place of the raw-socket BIO they otherwise install. Client/Server do
+// not consult it and always use the Go-implemented readBio/writeBio pair.
+type BIOFactory func() (rbio, wbio *BIO, err error)
+
+var (
+	bio_factories_mu sync.Mutex
+	bio_factories    = map[unsafe.Pointer]BIOFactory{}
+)
+
+// SetBIOFactory installs a custom BIOFactory, used by ClientFD/ServerFD in
+// place of the default socket BIO built from the supplied file descriptor.
+func (c *Ctx) SetBIOFactory(factory BIOFactory) {
+	bio_factories_mu.Lock()
+	bio_factories[unsafe.Pointer(c.ctx)] = factory
+	bio_factories_mu.Unlock()
+}
+
+func bioFactoryFor(ctx *C.SSL_CTX) BIOFactory {
+	bio_factories_mu.Lock()
+	defer bio_factories_mu.Unlock()
+	return bio_factories[unsafe.Pointer(ctx)]
+}
+
+// newConnFD builds a Conn directly around an existing, already-connected
+// file descriptor via BIO_new_socket (or, if one was installed with
+// SetBIOFactory, a custom BIO pair), instead of the Go-implemented
+// readBio/writeBio pair newConn uses for a net.Conn. This skips the
+// double-buffering and goroutine round-trips in
+// fillInputBuffer/flushOutputBuffer for the common case where the caller
+// already has a socket, and is required for kernel TLS offload, where the
+// kernel takes over the record layer once the handshake completes.
+func newConnFD(fd uintptr, ctx *Ctx) (*Conn, error) {
+	ssl, err := newSSL(ctx.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if factory := bioFactoryFor(ctx.ctx); factory != nil {
+		rbio, wbio, err := factory()
+		if err != nil {
+			C.SSL_free(ssl)
+			return nil, err
+		}
+		if rbio == nil || wbio == nil {
+			C.SSL_free(ssl)
+			return nil, errors.New("openssl: BIOFactory returned a nil BIO")
+		}
+		// SSL_set_bio transfers ownership of both BIOs to ssl, which frees
+		// them on SSL_free; clear the finalizers NewFDBIO installed so they
+		// don't also call BIO_free and double-free the underlying BIOs.
+		runtime.SetFinalizer(rbio, nil)
+		runtime.SetFinalizer(wbio, nil)
+		C.SSL_set_bio(ssl, rbio.bio, wbio.bio)
+	} else {
+		bio := C.BIO_new_socket(C.int(fd), C.int(0))
+		if bio == nil {
+			C.SSL_free(ssl)
+			return nil, errorFromErrorQueue()
+		}
+		// a socket BIO handles both directions; SSL_free only releases it
+		// once even when it's installed as both rbio and wbio
+		C.SSL_set_bio(ssl, bio, bio)
+	}
+
+	c := &Conn{
+		ssl:    ssl,
+		ctx:    ctx,
+		fd:     fd,
+		ownsFD: true,
+	}
+	runtime.SetFinalizer(c, func(c *Conn) {
+		C.SSL_free(c.ssl)
+	})
+	return c, nil
+}
+
+// ClientFD wraps an existing, already-connected file descriptor and puts it
+// in the connect state for any subsequent handshakes, bypassing net.Conn
+// entirely for zero-copy I/O. As with Client, callers are responsible for
+// verifying the peer's hostname and for setting up SNI.
+func ClientFD(fd uintptr, ctx *Ctx) (*Conn, error) {
+	c, err := newConnFD(fd, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_connect_state(c.ssl)
+	return c, nil
+}
+
+// ServerFD wraps an existing, already-connected file descriptor and puts it
+// in the accept state for any subsequent handshakes, bypassing net.Conn
+// entirely for zero-copy I/O.
+func ServerFD(fd uintptr, ctx *Ctx) (*Conn, error) {
+	c, err := newConnFD(fd, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_accept_state(c.ssl)
+	return c, nil
+}
@@ -36,6 +36,7 @@ import (
 	"net"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -58,6 +59,12 @@ type Conn struct {
 	is_shutdown      bool
 	mtx              sync.Mutex
 	want_read_future *utils.Future
+
+	// fd and ownsFD are only set for connections built by ClientFD/ServerFD,
+	// which wire OpenSSL directly to a file descriptor instead of going
+	// through conn/into_ssl/from_ssl. See newConnFD.
+	fd     uintptr
+	ownsFD bool
 }
 
 func newSSL(ctx *C.SSL_CTX) (*C.SSL, error) {
@@ -159,6 +166,11 @@ func (c *Conn) fillInputBuffer() error {
 }
 
 func (c *Conn) flushOutputBuffer() error {
+	if c.from_ssl == nil {
+		// fd-based connections write directly through the OS socket inside
+		// OpenSSL; there's no Go-side buffer to pump
+		return nil
+	}
 	_, err := c.from_ssl.WriteTo(c.conn)
 	return err
 }
@@ -172,6 +184,11 @@ func (c *Conn) getErrorHandler(rv C.int, errno error) func() error {
 			return io.ErrUnexpectedEOF
 		}
 	case C.SSL_ERROR_WANT_READ:
+		if c.into_ssl == nil {
+			// fd-based connections read directly from the OS socket inside
+			// OpenSSL; retrying SSL_do_handshake/SSL_read is all we need
+			return func() error { return tryAgain }
+		}
 		go c.flushOutputBuffer()
 		if c.want_read_future != nil {
 			want_read_future := c.want_read_future
@@ -370,7 +387,11 @@ func (c *Conn) Close() error {
 	c.mtx.Unlock()
 	var errs utils.ErrorGroup
 	errs.Add(c.shutdownLoop())
-	errs.Add(c.conn.Close())
+	if c.conn != nil {
+		errs.Add(c.conn.Close())
+	} else if c.ownsFD {
+		errs.Add(syscall.Close(int(c.fd)))
+	}
 	return errs.Finalize()
 }
 
@@ -461,28 +482,50 @@ func (c *Conn) VerifyHostname(host string) error {
 	return cert.VerifyHostname(host)
 }
 
-// LocalAddr returns the underlying connection's local address
+// LocalAddr returns the underlying connection's local address. It returns
+// nil for connections built with ClientFD/ServerFD, which have no net.Conn
+// to ask.
 func (c *Conn) LocalAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
 	return c.conn.LocalAddr()
 }
 
-// RemoteAddr returns the underlying connection's remote address
+// RemoteAddr returns the underlying connection's remote address. It returns
+// nil for connections built with ClientFD/ServerFD, which have no net.Conn
+// to ask.
 func (c *Conn) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
 	return c.conn.RemoteAddr()
 }
 
-// SetDeadline calls SetDeadline on the underlying connection.
+// SetDeadline calls SetDeadline on the underlying connection. It's not
+// supported for connections built with ClientFD/ServerFD.
 func (c *Conn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errors.New("openssl: SetDeadline not supported on fd-based connections")
+	}
 	return c.conn.SetDeadline(t)
 }
 
-// SetReadDeadline calls SetReadDeadline on the underlying connection.
+// SetReadDeadline calls SetReadDeadline on the underlying connection. It's
+// not supported for connections built with ClientFD/ServerFD.
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errors.New("openssl: SetReadDeadline not supported on fd-based connections")
+	}
 	return c.conn.SetReadDeadline(t)
 }
 
-// SetWriteDeadline calls SetWriteDeadline on the underlying connection.
+// SetWriteDeadline calls SetWriteDeadline on the underlying connection. It's
+// not supported for connections built with ClientFD/ServerFD.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.conn == nil {
+		return errors.New("openssl: SetWriteDeadline not supported on fd-based connections")
+	}
 	return c.conn.SetWriteDeadline(t)
 }
 
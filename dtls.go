@@ -0,0 +1,665 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdlib.h>
+// #include <string.h>
+// #include <sys/time.h>
+// #include <openssl/ssl.h>
+// #include <openssl/bio.h>
+// #include <openssl/err.h>
+//
+// static int DTLSv1_get_timeout_not_a_macro(SSL *ssl, struct timeval *tv) {
+//    return DTLSv1_get_timeout(ssl, tv);
+// }
+//
+// static int DTLSv1_listen_not_a_macro(SSL *ssl, BIO_ADDR *addr) {
+//    return DTLSv1_listen(ssl, addr);
+// }
+//
+// extern int cookie_generate_cb(SSL *ssl, unsigned char *cookie,
+//     unsigned int *cookie_len);
+// extern int cookie_verify_cb(SSL *ssl, const unsigned char *cookie,
+//     unsigned int cookie_len);
+import "C"
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// DTLSVersion selects which DTLS protocol version(s) a DTLS Ctx negotiates.
+type DTLSVersion int
+
+const (
+	// DTLSAny negotiates the highest mutually supported DTLS version.
+	DTLSAny DTLSVersion = iota
+	// DTLSv1_2Only restricts negotiation to DTLS 1.2.
+	DTLSv1_2Only
+)
+
+// NewDTLSCtx creates a Ctx for datagram TLS connections, built on
+// DTLS_method or DTLSv1_2_method depending on version. Use it with
+// DTLSClient/DTLSServer instead of Client/Server, and with
+// Ctx.SetCookieGenerateCb/SetCookieVerifyCb on the server side to defend
+// against UDP source-address spoofing via HelloVerifyRequest.
+func NewDTLSCtx(version DTLSVersion) (*Ctx, error) {
+	var method *C.SSL_METHOD
+	switch version {
+	case DTLSv1_2Only:
+		method = C.DTLSv1_2_method()
+	default:
+		method = C.DTLS_method()
+	}
+	if method == nil {
+		return nil, errors.New("openssl: unsupported DTLS version")
+	}
+	ctx := C.SSL_CTX_new(method)
+	if ctx == nil {
+		return nil, errorFromErrorQueue()
+	}
+	return &Ctx{ctx: ctx}, nil
+}
+
+// DTLSConn is a DTLS connection over a net.PacketConn, the datagram
+// counterpart to Conn. Unlike Conn, it assumes pc is already associated
+// with a single peer -- for servers that means demultiplexing incoming
+// packets by source address (e.g. with one connected UDP socket per peer)
+// happens before handing pc to DTLSServer; this package doesn't do
+// multi-peer demultiplexing itself.
+type DTLSConn struct {
+	pc    net.PacketConn
+	raddr net.Addr
+	ssl   *C.SSL
+	ctx   *Ctx // for gc
+	raw   syscall.RawConn
+
+	mtx          sync.Mutex
+	is_shutdown  bool
+	needs_listen bool
+
+	stop chan struct{}
+}
+
+func newDTLSConn(pc net.PacketConn, raddr net.Addr, ctx *Ctx) (*DTLSConn, error) {
+	ssl, err := newSSL(ctx.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := dgramFD(pc)
+	if err != nil {
+		C.SSL_free(ssl)
+		return nil, err
+	}
+	raw, err := pc.(syscall.Conn).SyscallConn()
+	if err != nil {
+		C.SSL_free(ssl)
+		return nil, err
+	}
+	if raddr != nil {
+		if err := connectUDP(fd, raddr); err != nil {
+			C.SSL_free(ssl)
+			return nil, err
+		}
+	}
+
+	bio := C.BIO_new_dgram(C.int(fd), C.int(0))
+	if bio == nil {
+		C.SSL_free(ssl)
+		return nil, errorFromErrorQueue()
+	}
+	C.SSL_set_bio(ssl, bio, bio)
+
+	c := &DTLSConn{
+		pc:    pc,
+		raddr: raddr,
+		ssl:   ssl,
+		ctx:   ctx,
+		raw:   raw,
+		stop:  make(chan struct{}),
+	}
+	runtime.SetFinalizer(c, func(c *DTLSConn) {
+		C.SSL_free(c.ssl)
+	})
+	go c.timeoutLoop()
+	return c, nil
+}
+
+// dgramFD extracts the underlying file descriptor of a net.PacketConn, so
+// it can be handed to BIO_new_dgram. Only PacketConns backed by an actual
+// OS socket (e.g. *net.UDPConn) are supported.
+func dgramFD(pc net.PacketConn) (uintptr, error) {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("openssl: DTLS requires a net.PacketConn backed by an OS socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd uintptr
+	if err := raw.Control(func(f uintptr) { fd = f }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+func connectUDP(fd uintptr, raddr net.Addr) error {
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	if !ok {
+		return errors.New("openssl: DTLS remote address must be a *net.UDPAddr")
+	}
+	sa, err := sockaddrFromUDPAddr(udpAddr)
+	if err != nil {
+		return err
+	}
+	return syscall.Connect(int(fd), sa)
+}
+
+// sockaddrFromUDPAddr converts a *net.UDPAddr into the syscall.Sockaddr
+// connectUDP needs to call syscall.Connect directly on the raw fd
+// BIO_new_dgram was handed, bypassing net.Conn's own connect path.
+func sockaddrFromUDPAddr(addr *net.UDPAddr) (syscall.Sockaddr, error) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	}
+	ip6 := addr.IP.To16()
+	if ip6 == nil {
+		return nil, errors.New("openssl: invalid DTLS remote address")
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], ip6)
+	if addr.Zone != "" {
+		iface, err := net.InterfaceByName(addr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		sa.ZoneId = uint32(iface.Index)
+	}
+	return sa, nil
+}
+
+// DTLSClient wraps pc, connected to raddr, and puts it in the connect
+// state for any subsequent handshakes.
+func DTLSClient(pc net.PacketConn, raddr net.Addr, ctx *Ctx) (*DTLSConn, error) {
+	c, err := newDTLSConn(pc, raddr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_connect_state(c.ssl)
+	return c, nil
+}
+
+// DTLSServer wraps pc and puts it in the accept state for any subsequent
+// handshakes. See the DTLSConn docs for the demultiplexing caveat. If ctx
+// has a CookieGenerateCb installed via SetCookieGenerateCb, Handshake
+// drives the HelloVerifyRequest/cookie exchange through DTLSv1_listen
+// before starting the handshake proper, so a client must echo back a
+// valid cookie before the server does any further handshake work.
+func DTLSServer(pc net.PacketConn, ctx *Ctx) (*DTLSConn, error) {
+	c, err := newDTLSConn(pc, nil, ctx)
+	if err != nil {
+		return nil, err
+	}
+	C.SSL_set_accept_state(c.ssl)
+	c.needs_listen = hasCookieGenerateCb(ctx.ctx)
+	return c, nil
+}
+
+// timeoutLoop periodically asks OpenSSL whether a DTLS retransmission
+// timer has expired and, if so, fires DTLSv1_handle_timeout to resend the
+// flight. Without this, lost handshake packets are never retransmitted.
+func (c *DTLSConn) timeoutLoop() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.mtx.Lock()
+			if c.is_shutdown {
+				c.mtx.Unlock()
+				return
+			}
+			var tv C.struct_timeval
+			if C.DTLSv1_get_timeout_not_a_macro(c.ssl, &tv) == 1 {
+				C.DTLSv1_handle_timeout(c.ssl)
+			}
+			c.mtx.Unlock()
+		}
+	}
+}
+
+// dtlsTimeout returns how long to wait for the next datagram before giving
+// up on it and letting the caller retry, bounded by OpenSSL's own
+// retransmission timer (DTLSv1_get_timeout) so a lost flight gets resent
+// promptly instead of waiting out a long, arbitrary poll.
+func (c *DTLSConn) dtlsTimeout() time.Duration {
+	const max = 500 * time.Millisecond
+	var tv C.struct_timeval
+	if C.DTLSv1_get_timeout_not_a_macro(c.ssl, &tv) != 1 {
+		return max
+	}
+	d := time.Duration(tv.tv_sec)*time.Second + time.Duration(tv.tv_usec)*time.Microsecond
+	if d <= 0 || d > max {
+		return max
+	}
+	return d
+}
+
+// waitReadable blocks the calling goroutine, parked on the runtime's
+// netpoller rather than spinning, until the underlying socket has a
+// datagram to read or dtlsTimeout elapses. pc's fd is non-blocking (it
+// came from a net.PacketConn), so without this SSL_ERROR_WANT_READ would
+// otherwise make the handshake/read retry loops spin at 100% CPU waiting
+// on I/O that hasn't happened yet.
+func (c *DTLSConn) waitReadable() error {
+	deadline := time.Now().Add(c.dtlsTimeout())
+	if err := c.pc.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer c.pc.SetReadDeadline(time.Time{})
+	err := c.raw.Read(func(fd uintptr) bool {
+		// RawConn.Read only parks on the netpoller while this predicate
+		// returns false; peek for an actual datagram (without consuming
+		// it, so OpenSSL still sees it) rather than reporting readable on
+		// the first call, or this never blocks at all.
+		var buf [1]byte
+		_, _, serr := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+		return serr != syscall.EAGAIN && serr != syscall.EWOULDBLOCK
+	})
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *DTLSConn) handshake() func() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return func() error { return errors.New("openssl: connection closed") }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_do_handshake(c.ssl)
+	if rv > 0 {
+		return nil
+	}
+	errcode := C.SSL_get_error(c.ssl, rv)
+	switch errcode {
+	case C.SSL_ERROR_WANT_READ:
+		// DTLS I/O happens directly against the OS socket via BIO_new_dgram;
+		// there's nothing to pump on the Go side, but the fd is
+		// non-blocking, so block here until a datagram arrives (or
+		// OpenSSL's retransmission timer is due) instead of spinning. The
+		// timeoutLoop goroutine is what makes retransmission of lost
+		// packets actually happen.
+		return func() error {
+			if err := c.waitReadable(); err != nil {
+				return err
+			}
+			return tryAgain
+		}
+	case C.SSL_ERROR_WANT_WRITE:
+		return func() error { return tryAgain }
+	default:
+		var err error
+		if C.ERR_peek_error() == 0 && errcode == C.SSL_ERROR_SYSCALL {
+			err = errno
+		} else {
+			err = errorFromErrorQueue()
+		}
+		return func() error { return err }
+	}
+}
+
+// listenStep calls DTLSv1_listen once, which either verifies a cookie the
+// peer already echoed back (success), sends a HelloVerifyRequest and asks
+// to be called again (no cookie yet, or a bad one), or fails outright.
+func (c *DTLSConn) listenStep() (done bool, errcb func() error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return false, func() error { return errors.New("openssl: connection closed") }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	addr := C.BIO_ADDR_new()
+	if addr == nil {
+		return false, func() error { return errorFromErrorQueue() }
+	}
+	defer C.BIO_ADDR_free(addr)
+
+	rv := C.DTLSv1_listen_not_a_macro(c.ssl, addr)
+	if rv > 0 {
+		return true, nil
+	}
+	if rv == 0 {
+		// no valid cookie yet; DTLSv1_listen already sent its own
+		// HelloVerifyRequest, so just wait for the client's retry
+		return false, func() error {
+			if err := c.waitReadable(); err != nil {
+				return err
+			}
+			return tryAgain
+		}
+	}
+	errcode := C.SSL_get_error(c.ssl, rv)
+	switch errcode {
+	case C.SSL_ERROR_WANT_READ:
+		return false, func() error {
+			if err := c.waitReadable(); err != nil {
+				return err
+			}
+			return tryAgain
+		}
+	case C.SSL_ERROR_WANT_WRITE:
+		return false, func() error { return tryAgain }
+	default:
+		var err error
+		if C.ERR_peek_error() == 0 && errcode == C.SSL_ERROR_SYSCALL {
+			err = errors.New("openssl: DTLSv1_listen syscall error")
+		} else {
+			err = errorFromErrorQueue()
+		}
+		return false, func() error { return err }
+	}
+}
+
+// dtlsListen drives the HelloVerifyRequest/cookie exchange to completion
+// before any other handshake state is created, per RFC 6347 section 4.2.1.
+func (c *DTLSConn) dtlsListen() error {
+	for {
+		done, errcb := c.listenStep()
+		if done {
+			return nil
+		}
+		if err := errcb(); err != tryAgain {
+			return err
+		}
+	}
+}
+
+// Handshake performs a DTLS handshake, including cookie exchange and
+// retransmission of lost flights.
+func (c *DTLSConn) Handshake() error {
+	c.mtx.Lock()
+	needsListen := c.needs_listen
+	c.mtx.Unlock()
+	if needsListen {
+		if err := c.dtlsListen(); err != nil {
+			return err
+		}
+		c.mtx.Lock()
+		c.needs_listen = false
+		c.mtx.Unlock()
+	}
+
+	err := tryAgain
+	for err == tryAgain {
+		if errcb := c.handshake(); errcb != nil {
+			err = errcb()
+		} else {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (c *DTLSConn) read(b []byte) (int, func() error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, func() error { return errors.New("openssl: connection closed") }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if rv > 0 {
+		return int(rv), nil
+	}
+	errcode := C.SSL_get_error(c.ssl, rv)
+	switch errcode {
+	case C.SSL_ERROR_WANT_READ:
+		return 0, func() error {
+			if err := c.waitReadable(); err != nil {
+				return err
+			}
+			return tryAgain
+		}
+	case C.SSL_ERROR_WANT_WRITE:
+		return 0, func() error { return tryAgain }
+	case C.SSL_ERROR_ZERO_RETURN:
+		return 0, func() error { return io.EOF }
+	default:
+		var err error
+		if C.ERR_peek_error() == 0 && errcode == C.SSL_ERROR_SYSCALL {
+			err = errno
+		} else {
+			err = errorFromErrorQueue()
+		}
+		return 0, func() error { return err }
+	}
+}
+
+// Read reads decrypted application data out of the DTLS connection,
+// retrying internally on transient conditions the way Conn.Read does.
+func (c *DTLSConn) Read(b []byte) (int, error) {
+	n, errcb := c.read(b)
+	if errcb != nil {
+		err := errcb()
+		for err == tryAgain {
+			n, errcb = c.read(b)
+			if errcb == nil {
+				return n, nil
+			}
+			err = errcb()
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+func (c *DTLSConn) write(b []byte) (int, func() error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return 0, func() error { return errors.New("openssl: connection closed") }
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rv, errno := C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+	if rv > 0 {
+		return int(rv), nil
+	}
+	errcode := C.SSL_get_error(c.ssl, rv)
+	switch errcode {
+	case C.SSL_ERROR_WANT_READ:
+		return 0, func() error {
+			if err := c.waitReadable(); err != nil {
+				return err
+			}
+			return tryAgain
+		}
+	case C.SSL_ERROR_WANT_WRITE:
+		return 0, func() error { return tryAgain }
+	default:
+		var err error
+		if C.ERR_peek_error() == 0 && errcode == C.SSL_ERROR_SYSCALL {
+			err = errno
+		} else {
+			err = errorFromErrorQueue()
+		}
+		return 0, func() error { return err }
+	}
+}
+
+// Write encrypts and sends b as a single DTLS record, retrying internally
+// on transient conditions the way Conn.Write does. DTLS preserves record
+// boundaries, so this never loops over partial writes: a record that doesn't fit the peer's MTU is a write error, not
+// something to retry in pieces.
+func (c *DTLSConn) Write(b []byte) (int, error) {
+	n, errcb := c.write(b)
+	if errcb != nil {
+		err := errcb()
+		for err == tryAgain {
+			n, errcb = c.write(b)
+			if errcb == nil {
+				return n, nil
+			}
+			err = errcb()
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// Close shuts down the DTLS connection and stops its retransmission timer.
+// The underlying net.PacketConn is left open, since DTLSServer users
+// typically share or reuse it across peers.
+func (c *DTLSConn) Close() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.is_shutdown = true
+	c.mtx.Unlock()
+	close(c.stop)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.SSL_shutdown(c.ssl)
+	return nil
+}
+
+// CookieGenerateCb generates an opaque cookie a client must echo back in a
+// second ClientHello, as a proof of address ownership before the server
+// commits any per-connection state. See SetCookieGenerateCb.
+type CookieGenerateCb func(ssl *SSL) ([]byte, error)
+
+// CookieVerifyCb checks a cookie returned by a client against the one the
+// server generated for it. See SetCookieVerifyCb.
+type CookieVerifyCb func(ssl *SSL, cookie []byte) bool
+
+var (
+	cookie_cbs_mu       sync.Mutex
+	cookie_generate_cbs = map[unsafe.Pointer]CookieGenerateCb{}
+	cookie_verify_cbs   = map[unsafe.Pointer]CookieVerifyCb{}
+)
+
+// SetCookieGenerateCb installs the callback used to generate the cookie a
+// server sends in a HelloVerifyRequest, defending against denial of
+// service via spoofed UDP source addresses. cb is typically an HMAC over
+// the client's address and a secret the server rotates periodically.
+func (c *Ctx) SetCookieGenerateCb(cb CookieGenerateCb) {
+	cookie_cbs_mu.Lock()
+	cookie_generate_cbs[unsafe.Pointer(c.ctx)] = cb
+	cookie_cbs_mu.Unlock()
+	C.SSL_CTX_set_cookie_generate_cb(c.ctx, (*[0]byte)(C.cookie_generate_cb))
+}
+
+// SetCookieVerifyCb installs the callback used to verify a cookie a client
+// echoed back in its second ClientHello. See SetCookieGenerateCb.
+func (c *Ctx) SetCookieVerifyCb(cb CookieVerifyCb) {
+	cookie_cbs_mu.Lock()
+	cookie_verify_cbs[unsafe.Pointer(c.ctx)] = cb
+	cookie_cbs_mu.Unlock()
+	C.SSL_CTX_set_cookie_verify_cb(c.ctx, (*[0]byte)(C.cookie_verify_cb))
+}
+
+// hasCookieGenerateCb reports whether ctx has a CookieGenerateCb installed,
+// which DTLSServer uses to decide whether Handshake needs to drive a
+// DTLSv1_listen cookie exchange before accepting.
+func hasCookieGenerateCb(ctx *C.SSL_CTX) bool {
+	cookie_cbs_mu.Lock()
+	defer cookie_cbs_mu.Unlock()
+	_, ok := cookie_generate_cbs[unsafe.Pointer(ctx)]
+	return ok
+}
+
+//export cookie_generate_cb_thunk
+func cookie_generate_cb_thunk(ssl *C.SSL, out *C.uchar, outlen *C.uint) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: cookie generate callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	cookie_cbs_mu.Lock()
+	cb := cookie_generate_cbs[unsafe.Pointer(C.SSL_get_SSL_CTX(ssl))]
+	cookie_cbs_mu.Unlock()
+	if cb == nil {
+		return 0
+	}
+
+	s := &SSL{ssl: ssl}
+	cookie, err := cb(s)
+	if err != nil || len(cookie) == 0 || len(cookie) > 255 {
+		return 0
+	}
+	C.memcpy(unsafe.Pointer(out), unsafe.Pointer(&cookie[0]), C.size_t(len(cookie)))
+	*outlen = C.uint(len(cookie))
+	return 1
+}
+
+//export cookie_verify_cb_thunk
+func cookie_verify_cb_thunk(ssl *C.SSL, cookie *C.uchar, cookielen C.uint) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: cookie verify callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	cookie_cbs_mu.Lock()
+	cb := cookie_verify_cbs[unsafe.Pointer(C.SSL_get_SSL_CTX(ssl))]
+	cookie_cbs_mu.Unlock()
+	if cb == nil {
+		return 0
+	}
+
+	s := &SSL{ssl: ssl}
+	got := C.GoBytes(unsafe.Pointer(cookie), C.int(cookielen))
+	if cb(s, got) {
+		return 1
+	}
+	return 0
+}
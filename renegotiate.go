@@ -0,0 +1,144 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <openssl/ssl.h>
+//
+// extern void renegotiate_info_cb(const SSL *ssl, int where, int ret);
+import "C"
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// RenegotiationMode controls whether, and how often, a Ctx's connections
+// allow renegotiation, whether initiated by the peer or via
+// Conn.Renegotiate.
+type RenegotiationMode int
+
+const (
+	// RenegotiateNever rejects any renegotiation attempt.
+	RenegotiateNever RenegotiationMode = iota
+	// RenegotiateOnce allows exactly one renegotiation per connection, the
+	// common pattern for a server that wants to request a client
+	// certificate only after seeing the HTTP request path.
+	RenegotiateOnce
+	// RenegotiateFreely allows any number of renegotiations.
+	RenegotiateFreely
+)
+
+var (
+	renegotiation_modes_mu sync.Mutex
+	renegotiation_modes    = map[unsafe.Pointer]RenegotiationMode{}
+)
+
+// SetRenegotiationMode controls whether, and how often, this Ctx's
+// connections allow peer-initiated renegotiation, as well as
+// Conn.Renegotiate.
+func (c *Ctx) SetRenegotiationMode(mode RenegotiationMode) {
+	renegotiation_modes_mu.Lock()
+	renegotiation_modes[unsafe.Pointer(c.ctx)] = mode
+	renegotiation_modes_mu.Unlock()
+
+	if mode == RenegotiateNever {
+		C.SSL_CTX_set_options(c.ctx, C.SSL_OP_NO_RENEGOTIATION)
+	} else {
+		C.SSL_CTX_clear_options(c.ctx, C.SSL_OP_NO_RENEGOTIATION)
+	}
+	// used to enforce RenegotiateOnce, which OpenSSL has no native concept
+	// of: we disable further renegotiation on a connection the moment we
+	// see its first one start
+	C.SSL_CTX_set_info_callback(c.ctx, (*[0]byte)(C.renegotiate_info_cb))
+}
+
+func renegotiationModeFor(ctx *C.SSL_CTX) RenegotiationMode {
+	renegotiation_modes_mu.Lock()
+	defer renegotiation_modes_mu.Unlock()
+	mode, ok := renegotiation_modes[unsafe.Pointer(ctx)]
+	if !ok {
+		return RenegotiateFreely
+	}
+	return mode
+}
+
+//export renegotiate_info_cb_thunk
+func renegotiate_info_cb_thunk(ssl *C.SSL, where C.int, ret C.int) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: renegotiation info callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	if where&C.SSL_CB_HANDSHAKE_START == 0 {
+		return
+	}
+	// SSL_is_init_finished is true here only if this HANDSHAKE_START event
+	// is for a renegotiation, not the connection's original handshake
+	if C.SSL_is_init_finished(ssl) == 0 {
+		return
+	}
+	if renegotiationModeFor(C.SSL_get_SSL_CTX(ssl)) == RenegotiateOnce {
+		C.SSL_set_options(ssl, C.SSL_OP_NO_RENEGOTIATION)
+	}
+}
+
+// Renegotiate triggers a new TLS handshake on an already-established
+// connection, e.g. to rekey a long-lived connection or, on the server
+// side, to request a client certificate partway through a session. It
+// shares the same want_read_future machinery Read uses, so a concurrent
+// Read blocked waiting on the underlying connection will pick up bytes
+// delivered during the renegotiation exchange instead of racing with it.
+func (c *Conn) Renegotiate() error {
+	c.mtx.Lock()
+	if c.is_shutdown {
+		c.mtx.Unlock()
+		return errors.New("openssl: connection closed")
+	}
+	runtime.LockOSThread()
+	rv := C.SSL_renegotiate(c.ssl)
+	runtime.UnlockOSThread()
+	c.mtx.Unlock()
+	if rv != 1 {
+		return errorFromErrorQueue()
+	}
+	return c.Handshake()
+}
+
+// VerifyClientPostHandshake requests post-handshake client authentication
+// on a TLS 1.3 connection -- e.g. once a server has seen enough of an HTTP
+// request to know it needs a client certificate, without having asked for
+// one up front. The actual certificate exchange happens transparently
+// inside the next call to Read, which callers must make (retrying on
+// transient errors as usual) to drive it to completion.
+func (c *Conn) VerifyClientPostHandshake() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.is_shutdown {
+		return errors.New("openssl: connection closed")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if C.SSL_verify_client_post_handshake(c.ssl) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright (C) 2014 Space Monkey, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build cgo
+
+package openssl
+
+// #include <stdlib.h>
+// #include <string.h>
+// #include <openssl/ssl.h>
+//
+// extern int sess_new_cb_thunk(SSL *ssl, SSL_SESSION *sess);
+// extern SSL_SESSION *sess_get_cb_thunk(SSL *ssl, const unsigned char *id,
+//     int idlen, int *do_copy);
+// extern void sess_remove_cb_thunk(SSL_CTX *sslctx, SSL_SESSION *sess);
+import "C"
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// SessionCacheMode controls how and whether SSL/TLS sessions are cached for
+// later resumption. See
+// https://www.openssl.org/docs/man1.1.1/man3/SSL_CTX_set_session_cache_mode.html
+type SessionCacheMode int
+
+const (
+	SessionCacheOff              SessionCacheMode = C.SSL_SESS_CACHE_OFF
+	SessionCacheClient           SessionCacheMode = C.SSL_SESS_CACHE_CLIENT
+	SessionCacheServer           SessionCacheMode = C.SSL_SESS_CACHE_SERVER
+	SessionCacheBoth             SessionCacheMode = C.SSL_SESS_CACHE_BOTH
+	SessionCacheNoAutoClear      SessionCacheMode = C.SSL_SESS_CACHE_NO_AUTO_CLEAR
+	SessionCacheNoInternal       SessionCacheMode = C.SSL_SESS_CACHE_NO_INTERNAL
+	SessionCacheNoInternalLookup SessionCacheMode = C.SSL_SESS_CACHE_NO_INTERNAL_LOOKUP
+	SessionCacheNoInternalStore  SessionCacheMode = C.SSL_SESS_CACHE_NO_INTERNAL_STORE
+)
+
+// SetSessionCacheMode enables or disables OpenSSL's built-in session cache
+// and controls which side (client, server, or both) it applies to. See
+// https://www.openssl.org/docs/man1.1.1/man3/SSL_CTX_set_session_cache_mode.html
+func (c *Ctx) SetSessionCacheMode(mode SessionCacheMode) SessionCacheMode {
+	return SessionCacheMode(C.SSL_CTX_set_session_cache_mode(c.ctx, C.long(mode)))
+}
+
+// SetSessionIDContext sets the context byte string used to distinguish this
+// Ctx's sessions from those of other, unrelated contexts when caching.
+// OpenSSL requires this whenever client certificate verification is in use
+// and the session cache is enabled. See
+// https://www.openssl.org/docs/man1.1.1/man3/SSL_CTX_set_session_id_context.html
+func (c *Ctx) SetSessionIDContext(sid []byte) error {
+	if len(sid) == 0 {
+		return nil
+	}
+	if C.SSL_CTX_set_session_id_context(c.ctx, (*C.uchar)(&sid[0]),
+		C.uint(len(sid))) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// SetTicketKeys installs the keys used to encrypt and decrypt TLS session
+// tickets, allowing resumption to survive a process restart or to be shared
+// across a fleet of servers. keys must be 48 bytes (16 bytes name, 16 bytes
+// AES key, 16 bytes HMAC key); callers are responsible for rotating them.
+// See https://www.openssl.org/docs/man1.1.1/man3/SSL_CTX_set_tlsext_ticket_keys.html
+func (c *Ctx) SetTicketKeys(keys []byte) error {
+	if len(keys) != 48 {
+		return errors.New("openssl: ticket keys must be 48 bytes")
+	}
+	if C.SSL_CTX_ctrl(c.ctx, C.SSL_CTRL_SET_TLSEXT_TICKET_KEYS,
+		C.long(len(keys)), unsafe.Pointer(&keys[0])) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// GetSession serializes the current session (via i2d_SSL_SESSION) so it can
+// be stashed and later handed to SetSession to resume without a full
+// handshake, possibly from a different process or machine. Only useful on
+// client connections.
+func (c *Conn) GetSession() ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	session := C.SSL_get1_session(c.ssl)
+	if session == nil {
+		return nil, errors.New("openssl: no session available")
+	}
+	defer C.SSL_SESSION_free(session)
+
+	size := C.i2d_SSL_SESSION(session, nil)
+	if size <= 0 {
+		return nil, errorFromErrorQueue()
+	}
+	der := make([]byte, size)
+	p := (*C.uchar)(&der[0])
+	if C.i2d_SSL_SESSION(session, &p) <= 0 {
+		return nil, errorFromErrorQueue()
+	}
+	return der, nil
+}
+
+// SetSession installs a previously-serialized session (see GetSession) on
+// this connection, to be offered for resumption on the next handshake. Only
+// useful on client connections, and must be called before Handshake.
+func (c *Conn) SetSession(der []byte) error {
+	if len(der) == 0 {
+		return errors.New("openssl: empty session")
+	}
+	p := (*C.uchar)(&der[0])
+	session := C.d2i_SSL_SESSION(nil, &p, C.long(len(der)))
+	if session == nil {
+		return errorFromErrorQueue()
+	}
+	defer C.SSL_SESSION_free(session)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if C.SSL_set_session(c.ssl, session) != 1 {
+		return errorFromErrorQueue()
+	}
+	return nil
+}
+
+// GetSessionCacheCb is called to look up a previously stored session by its
+// session ID. It should return the serialized session (as produced by
+// Conn.GetSession) and true, or nil and false if there is no such session.
+type GetSessionCacheCb func(id []byte) (session []byte, ok bool)
+
+// NewSessionCacheCb is called whenever a new session is established and
+// should be stored for later resumption, keyed by id.
+type NewSessionCacheCb func(id []byte, session []byte)
+
+// RemoveSessionCacheCb is called whenever OpenSSL invalidates a cached
+// session, e.g. because the peer reported an error using it.
+type RemoveSessionCacheCb func(id []byte)
+
+type sessionCacheCallbacks struct {
+	get    GetSessionCacheCb
+	new_cb NewSessionCacheCb
+	remove RemoveSessionCacheCb
+}
+
+var (
+	session_cache_mu  sync.Mutex
+	session_cache_cbs = map[unsafe.Pointer]*sessionCacheCallbacks{}
+)
+
+// SetSessionCache wires up an external, server-side session cache (e.g.
+// memcached or Redis) in place of OpenSSL's built-in in-memory cache. get is
+// called to satisfy resumption requests from clients, new_cb whenever a
+// session should be stored, and remove whenever OpenSSL invalidates one.
+// Callers must still enable caching with SetSessionCacheMode and usually
+// want to pair this with SessionCacheNoInternal so the built-in cache
+// doesn't also keep its own copies.
+func (c *Ctx) SetSessionCache(get GetSessionCacheCb, new_cb NewSessionCacheCb,
+	remove RemoveSessionCacheCb) {
+	session_cache_mu.Lock()
+	session_cache_cbs[unsafe.Pointer(c.ctx)] = &sessionCacheCallbacks{
+		get:    get,
+		new_cb: new_cb,
+		remove: remove,
+	}
+	session_cache_mu.Unlock()
+
+	C.SSL_CTX_sess_set_new_cb(c.ctx, (*[0]byte)(C.sess_new_cb_thunk))
+	C.SSL_CTX_sess_set_get_cb(c.ctx, (*[0]byte)(C.sess_get_cb_thunk))
+	C.SSL_CTX_sess_set_remove_cb(c.ctx, (*[0]byte)(C.sess_remove_cb_thunk))
+}
+
+func sessionID(sess *C.SSL_SESSION) []byte {
+	var idlen C.uint
+	id := C.SSL_SESSION_get_id(sess, &idlen)
+	if idlen == 0 {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(id), C.int(idlen))
+}
+
+//export sess_new_cb_thunk
+func sess_new_cb_thunk(ssl *C.SSL, sess *C.SSL_SESSION) C.int {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: session new callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	cbs := sessionCallbacksFor(C.SSL_get_SSL_CTX(ssl))
+	if cbs == nil || cbs.new_cb == nil {
+		return 0
+	}
+
+	size := C.i2d_SSL_SESSION(sess, nil)
+	if size <= 0 {
+		return 0
+	}
+	der := make([]byte, size)
+	p := (*C.uchar)(&der[0])
+	if C.i2d_SSL_SESSION(sess, &p) <= 0 {
+		return 0
+	}
+	cbs.new_cb(sessionID(sess), der)
+	// we took a copy, not a reference, so tell OpenSSL to manage its own
+	return 0
+}
+
+//export sess_get_cb_thunk
+func sess_get_cb_thunk(ssl *C.SSL, id *C.uchar, idlen C.int,
+	do_copy *C.int) *C.SSL_SESSION {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: session get callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	cbs := sessionCallbacksFor(C.SSL_get_SSL_CTX(ssl))
+	if cbs == nil || cbs.get == nil {
+		return nil
+	}
+
+	der, ok := cbs.get(C.GoBytes(unsafe.Pointer(id), idlen))
+	if !ok || len(der) == 0 {
+		return nil
+	}
+	p := (*C.uchar)(&der[0])
+	sess := C.d2i_SSL_SESSION(nil, &p, C.long(len(der)))
+	if sess == nil {
+		return nil
+	}
+	// d2i_SSL_SESSION hands back a session with a fresh reference count of
+	// one, which we're handing off to OpenSSL, so tell it not to take
+	// another one
+	*do_copy = 0
+	return sess
+}
+
+//export sess_remove_cb_thunk
+func sess_remove_cb_thunk(sslctx *C.SSL_CTX, sess *C.SSL_SESSION) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Critf("openssl: session remove callback panic'd: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	cbs := sessionCallbacksFor(sslctx)
+	if cbs == nil || cbs.remove == nil {
+		return
+	}
+	cbs.remove(sessionID(sess))
+}
+
+func sessionCallbacksFor(ctx *C.SSL_CTX) *sessionCacheCallbacks {
+	session_cache_mu.Lock()
+	defer session_cache_mu.Unlock()
+	return session_cache_cbs[unsafe.Pointer(ctx)]
+}
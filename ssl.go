@@ -21,6 +21,7 @@ package openssl
 #include <openssl/ssl.h>
 #include <openssl/err.h>
 #include <openssl/conf.h>
+#include <openssl/x509_vfy.h>
 
 static long SSL_set_options_not_a_macro(SSL* ssl, long options) {
    return SSL_set_options(ssl, options);
@@ -74,10 +75,37 @@ func verify_ssl_cb_thunk(p unsafe.Pointer, ok C.int, ctx *C.X509_STORE_CTX) C.in
 			os.Exit(1)
 		}
 	}()
-	verify_cb := (*SSL)(p).verify_cb
+	s := (*SSL)(p)
+	store := &CertificateStoreCtx{ctx: ctx}
+	verify_cb := s.verify_cb
+
+	if av := asyncVerifierFor(C.SSL_get_SSL_CTX(s.ssl)); av != nil {
+		// SSL_set_verify's callback fires once per certificate in the
+		// chain (root first, error_depth counting down toward the leaf);
+		// the async verifier wants the complete chain in one request, so
+		// only call out to the helper on the last invocation, once
+		// OpenSSL has finished building the chain and error_depth has
+		// reached the leaf's depth of 0. Every other depth just keeps OpenSSL's
+		// own verification result.
+		if C.X509_STORE_CTX_get_error_depth(ctx) != 0 {
+			return ok
+		}
+		host := C.GoString(C.SSL_get_servername(s.ssl, C.TLSEXT_NAMETYPE_host_name))
+		if av.verify(store, host) {
+			ok = 1
+		} else {
+			ok = 0
+		}
+		// the async verifier runs in addition to, not instead of, a
+		// VerifyCallback set via SSL.SetVerify
+		if verify_cb != nil && !verify_cb(ok == 1, store) {
+			ok = 0
+		}
+		return ok
+	}
+
 	// set up defaults just in case verify_cb is nil
 	if verify_cb != nil {
-		store := &CertificateStoreCtx{ctx: ctx}
 		if verify_cb(ok == 1, store) {
 			ok = 1
 		} else {